@@ -11,8 +11,12 @@
 package smbus2_go
 
 import (
+	"errors"
 	"fmt"
+	"runtime"
+	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -24,6 +28,8 @@ const (
 	I2CSlaveForce = 0x0706
 	// Get the adapter functionality mask
 	I2CFuncs = 0x0705
+	// Use 10-bit addressing for the next transfer, if != 0
+	I2CTenBit = 0x0704
 	// Combined R/W transfer (one STOP only)
 	I2CRDWR = 0x0707
 	// SMBus transfer. Takes pointer to i2c_smbus_ioctl_data
@@ -84,6 +90,14 @@ const (
 
 	// i2c_msg flags from uapi/linux/i2c.h
 	I2CMRD = 0x0001
+	// This message's addr is a 10-bit address.
+	I2CMTen = 0x0010
+	// IGNORE_NAK, NOSTART, REV_DIR_ADDR are used by bus drivers.
+	I2CMIgnoreNak = 0x1000
+	I2CMNoStart   = 0x4000
+	// The first byte read is the remaining message length, not counting
+	// the length byte itself. Used by the kernel's SMBus-block emulation.
+	I2CMRecvLen = 0x0400
 )
 
 // These represent a bitfield indicating the capabilities of a bus.
@@ -196,10 +210,73 @@ func (f FunctionFlags) GetStringsList() []string {
 	return toReturn
 }
 
+// Abstracts the handful of kernel entry points this package needs, so that
+// tests can inject a fake implementation instead of talking to a real I2C
+// bus. linuxSyscaller is the only production implementation.
+//
+// Ioctl takes the argument as an unsafe.Pointer rather than a uintptr: the
+// conversion to uintptr must happen inline in the actual syscall.Syscall
+// call, not in an intermediate variable, or the garbage collector may move
+// or free the pointed-to memory before the syscall runs. See
+// https://pkg.go.dev/unsafe#Pointer rule (4).
+type SystemCaller interface {
+	Open(path string, flags int, mode uint32) (int, error)
+	Close(fd int) error
+	Ioctl(fd int, cmd uintptr, arg unsafe.Pointer) syscall.Errno
+	// Like Ioctl, but for commands such as I2C_SLAVE, I2C_PEC, and
+	// I2C_TENBIT that take their argument as a plain integer rather than
+	// a pointer.
+	IoctlInt(fd int, cmd uintptr, arg int) syscall.Errno
+	Read(fd int, buf []byte) (int, error)
+	Write(fd int, buf []byte) (int, error)
+}
+
+// The SystemCaller used by NewSMBus and NewSMBusWithPath unless overridden
+// via SMBus.SetSystemCaller.
+var DefaultSystemCaller SystemCaller = linuxSyscaller{}
+
+// The production SystemCaller, backed directly by the syscall package.
+type linuxSyscaller struct{}
+
+func (linuxSyscaller) Open(path string, flags int, mode uint32) (int, error) {
+	return syscall.Open(path, flags, mode)
+}
+
+func (linuxSyscaller) Close(fd int) error {
+	return syscall.Close(fd)
+}
+
+func (linuxSyscaller) Ioctl(fd int, cmd uintptr, arg unsafe.Pointer) syscall.Errno {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), cmd, uintptr(arg))
+	return errno
+}
+
+func (linuxSyscaller) IoctlInt(fd int, cmd uintptr, arg int) syscall.Errno {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), cmd, uintptr(arg))
+	return errno
+}
+
+func (linuxSyscaller) Read(fd int, buf []byte) (int, error) {
+	return syscall.Read(fd, buf)
+}
+
+func (linuxSyscaller) Write(fd int, buf []byte) (int, error) {
+	return syscall.Write(fd, buf)
+}
+
 // Provides a ioctl wrapper that works with the syscall library. Sorry for the
 // unsafe usage.
-func ioctl(fd int, cmd uintptr, arg uintptr) error {
-	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), cmd, arg)
+func ioctl(caller SystemCaller, fd int, cmd uintptr, arg unsafe.Pointer) error {
+	errno := caller.Ioctl(fd, cmd, arg)
+	if errno != 0 {
+		return fmt.Errorf("Error making ioctl: %w", errno)
+	}
+	return nil
+}
+
+// Like ioctl, but for commands that take a plain integer argument.
+func ioctlInt(caller SystemCaller, fd int, cmd uintptr, arg int) error {
+	errno := caller.IoctlInt(fd, cmd, arg)
 	if errno != 0 {
 		return fmt.Errorf("Error making ioctl: %w", errno)
 	}
@@ -208,18 +285,35 @@ func ioctl(fd int, cmd uintptr, arg uintptr) error {
 
 // Tracks state for a single open bus.
 type SMBus struct {
-	fd int
+	fd     int
+	caller SystemCaller
+	// Guards fd (and the currently-selected slave address) against
+	// concurrent use by multiple goroutines. Held for the duration of
+	// every Do call, and of every SMBus-level convenience method below.
+	mu sync.Mutex
 	// A bitfield indicating what functions are supported by the I2C device.
 	Funcs             FunctionFlags
 	forceSlaveAddress bool
 	forceLast         bool
 	pec               uint32
+	// When true, the SMBus protocol methods below always use the
+	// I2CRDWR emulation path, even if Funcs reports native SMBus
+	// support. Mainly useful for exercising the emulation code on
+	// adapters that would otherwise take the native path.
+	PreferEmulation bool
+}
+
+// Overrides the SystemCaller used for all subsequent kernel entry points on
+// b. Mainly intended for tests that want to inject faults into a specific
+// ioctl without talking to a real I2C bus.
+func (b *SMBus) SetSystemCaller(caller SystemCaller) {
+	b.caller = caller
 }
 
 // Should be called when the SMBus connection is no longer needed. Closes the
 // underlying file descriptor.
 func (b *SMBus) Close() error {
-	e := syscall.Close(b.fd)
+	e := b.caller.Close(b.fd)
 	b.fd = -1
 	return e
 }
@@ -231,18 +325,962 @@ func NewSMBus(busID int) (*SMBus, error) {
 
 // Like NewSMBus, but takes a path to an smbus device, i.e., "/dev/i2c-0".
 func NewSMBusWithPath(path string) (*SMBus, error) {
-	fd, e := syscall.Open(path, syscall.O_RDWR, 0666)
+	caller := DefaultSystemCaller
+	fd, e := caller.Open(path, syscall.O_RDWR, 0666)
 	if e != nil {
 		return nil, fmt.Errorf("Error opening %s: %w", path, e)
 	}
 	funcs := uint32(0)
-	e = ioctl(fd, I2CFuncs, uintptr(unsafe.Pointer(&funcs)))
+	e = ioctl(caller, fd, I2CFuncs, unsafe.Pointer(&funcs))
 	if e != nil {
-		syscall.Close(fd)
+		caller.Close(fd)
 		return nil, fmt.Errorf("Error getting funcs for %s: %w", path, e)
 	}
 	return &SMBus{
-		fd:    fd,
-		Funcs: FunctionFlags(funcs),
+		fd:     fd,
+		caller: caller,
+		Funcs:  FunctionFlags(funcs),
 	}, nil
+}
+
+// Issues the I2C_SLAVE (or I2C_SLAVE_FORCE) ioctl selecting addr as the
+// target of subsequent SMBus and Transfer calls on b. Callers must hold
+// b.mu.
+func (b *SMBus) selectSlave(addr uint16) error {
+	cmd := uintptr(I2CSlave)
+	if b.forceSlaveAddress {
+		cmd = I2CSlaveForce
+	}
+	e := ioctlInt(b.caller, b.fd, cmd, int(addr))
+	if e != nil {
+		return fmt.Errorf("Error selecting slave address 0x%02x: %w", addr, e)
+	}
+	return nil
+}
+
+// A handle scoped to a single slave address on a bus, obtained from Do. Its
+// methods mirror the SMBus methods of the same name, but without the addr
+// argument, since the address was already selected for the lifetime of the
+// Do call.
+type Device struct {
+	bus  *SMBus
+	addr uint16
+}
+
+// Acquires exclusive use of the bus, selects addr as the active slave
+// address, and calls fn with a Device scoped to that address. This is the
+// safe way to talk to a specific device from multiple goroutines sharing
+// one SMBus: the address selection and the following transaction(s) happen
+// atomically with respect to other callers of Do.
+func (b *SMBus) Do(addr uint16, fn func(d *Device) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.selectSlave(addr)
+	if e != nil {
+		return e
+	}
+	return fn(&Device{bus: b, addr: addr})
+}
+
+// Enables or disables PEC (Packet Error Checking) on the bus. Requires the
+// adapter to advertise SMBUSPECFlag. The setting is not restored when Do
+// returns; it stays in effect for later calls on the bus.
+func (d *Device) SetPEC(enable bool) error {
+	if !d.bus.Funcs.BitsSet(SMBUSPECFlag) {
+		return ErrUnsupported
+	}
+	v := uint32(0)
+	if enable {
+		v = 1
+	}
+	e := ioctlInt(d.bus.caller, d.bus.fd, I2CPEC, int(v))
+	if e != nil {
+		return fmt.Errorf("Error setting PEC: %w", e)
+	}
+	d.bus.pec = v
+	return nil
+}
+
+// Returned by EnablePEC when the adapter doesn't advertise SMBUSPECFlag.
+var ErrUnsupported = errors.New("adapter does not support this operation")
+
+// Indicates that a PEC (CRC-8) byte appended to an emulated SMBus
+// transaction didn't match the data it was supposed to protect.
+type PECError struct {
+	Expected uint8
+	Got      uint8
+}
+
+func (e *PECError) Error() string {
+	return fmt.Sprintf("PEC mismatch: expected 0x%02x, got 0x%02x", e.Expected, e.Got)
+}
+
+// Enables or disables PEC (Packet Error Checking) for all subsequent SMBus
+// transactions on b, including the I2CRDWR emulation path used for adapters
+// that lack native SMBus support. Returns ErrUnsupported if the adapter
+// doesn't advertise SMBUSPECFlag. For the native I2C_SMBUS path, the kernel
+// appends and verifies the CRC byte transparently; for the emulation path,
+// this package computes and checks it itself.
+func (b *SMBus) EnablePEC(enable bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.Funcs.BitsSet(SMBUSPECFlag) {
+		return ErrUnsupported
+	}
+	v := uint32(0)
+	if enable {
+		v = 1
+	}
+	e := ioctlInt(b.caller, b.fd, I2CPEC, int(v))
+	if e != nil {
+		return fmt.Errorf("Error setting PEC: %w", e)
+	}
+	b.pec = v
+	return nil
+}
+
+// Returns the byte an address appears as on the wire in a CRC-8 PEC
+// computation: the 7-bit address shifted left one, with the low bit set for
+// a read.
+func pecAddrByte(addr uint16, read bool) byte {
+	v := byte(addr << 1)
+	if read {
+		v |= 1
+	}
+	return v
+}
+
+// Computes the SMBus PEC: a CRC-8 with polynomial x^8+x^2+x+1 (0x07), run
+// over the concatenation of parts in order.
+func smbusPEC(parts ...[]byte) uint8 {
+	var crc uint8
+	for _, part := range parts {
+		for _, b := range part {
+			crc ^= b
+			for i := 0; i < 8; i++ {
+				if crc&0x80 != 0 {
+					crc = (crc << 1) ^ 0x07
+				} else {
+					crc <<= 1
+				}
+			}
+		}
+	}
+	return crc
+}
+
+// Appends a PEC byte to data, a write-only emulated transaction's payload,
+// if PEC is enabled on b. No-op otherwise.
+func (b *SMBus) appendPEC(addr uint16, data []byte) []byte {
+	if b.pec == 0 {
+		return data
+	}
+	crc := smbusPEC([]byte{pecAddrByte(addr, false)}, data)
+	return append(data, crc)
+}
+
+// Verifies and strips the trailing PEC byte from read, the buffer returned
+// by the read half of an emulated transaction, if PEC is enabled on b.
+// written is the payload of a preceding write half (e.g. a command byte)
+// for a write-then-read transaction such as ReadByteData, in which case the
+// CRC covers addr+Wr, written, addr+Rd, then read's data. written is nil
+// for a transaction with no write phase at all, such as a plain ReadByte
+// ("Receive Byte"), in which case the wire only ever saw addr+Rd followed
+// by read's data, and the phantom write-address byte must not be included
+// in the CRC. Returns read unchanged if PEC is disabled.
+func (b *SMBus) checkReadPEC(addr uint16, written []byte, read []byte) ([]byte, error) {
+	if b.pec == 0 {
+		return read, nil
+	}
+	n := len(read) - 1
+	var expected uint8
+	if written == nil {
+		expected = smbusPEC([]byte{pecAddrByte(addr, true)}, read[:n])
+	} else {
+		expected = smbusPEC([]byte{pecAddrByte(addr, false)}, written,
+			[]byte{pecAddrByte(addr, true)}, read[:n])
+	}
+	got := read[n]
+	if got != expected {
+		return nil, &PECError{Expected: expected, Got: got}
+	}
+	return read[:n], nil
+}
+
+// Enables or disables 10-bit addressing on the bus. The setting is not reset
+// when Do returns; it stays in effect for later calls on the bus.
+func (d *Device) SetTenBit(enable bool) error {
+	v := 0
+	if enable {
+		v = 1
+	}
+	e := ioctlInt(d.bus.caller, d.bus.fd, I2CTenBit, v)
+	if e != nil {
+		return fmt.Errorf("Error setting 10-bit addressing: %w", e)
+	}
+	return nil
+}
+
+// A single message within a combined I2CRDWR transfer. Mirrors struct
+// i2c_msg from uapi/linux/i2c.h. Flags may be a combination of I2CMRD,
+// I2CMTen, I2CMNoStart, and I2CMIgnoreNak. For a read message (Flags has
+// I2CMRD set), Data must be preallocated to the desired read length; it
+// will be overwritten in place with the bytes returned by the device.
+type I2CMessage struct {
+	Addr  uint16
+	Flags uint16
+	Data  []byte
+
+	// Overrides the on-wire i2c_msg.len sent to the kernel for this
+	// message. Zero means "use len(Data)", which is correct for every
+	// message except an I2CMRecvLen read: per uapi/linux/i2c.h, the
+	// kernel treats the caller-supplied len there as the initial
+	// byte-count budget (1, or 2 with PEC) and grows it itself once it
+	// learns the device-reported length, rather than trusting the full
+	// capacity of the oversized buffer Data points at. Only this
+	// package's own I2CMRecvLen emulation paths need to set it; it's
+	// unexported, so Transfer callers composing their own I2CMRecvLen
+	// messages can't rely on it and must size Data to the initial budget
+	// themselves.
+	initialRecvLen uint16
+}
+
+// Mirrors struct i2c_msg from uapi/linux/i2c.h.
+type i2cMsg struct {
+	addr  uint16
+	flags uint16
+	len   uint16
+	buf   unsafe.Pointer
+}
+
+// Mirrors struct i2c_rdwr_ioctl_data from uapi/linux/i2c-dev.h.
+type i2cRdwrIoctlData struct {
+	msgs  unsafe.Pointer
+	nmsgs uint32
+}
+
+// Submits the given messages as a single combined I2C_RDWR transaction: one
+// START, repeated (restart) between each message, and a single STOP at the
+// end. Read messages (those with I2CMRD set in Flags) have their Data
+// buffers overwritten in place with the bytes read from the device. This is
+// lower-level than the SMBus methods below, but allows write-then-read
+// transactions that the SMBus protocol can't express. Each message carries
+// its own Addr, so (unlike the SMBus methods below) this doesn't require
+// going through Do.
+func (b *SMBus) Transfer(msgs []I2CMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.transfer(msgs)
+}
+
+// Like Transfer, but for use within a Do call: within d.bus.Do(...), use
+// d.Transfer(msgs) instead, which forwards here.
+func (d *Device) Transfer(msgs []I2CMessage) error {
+	return d.bus.transfer(msgs)
+}
+
+// The lock-free implementation shared by Transfer and Device.Transfer.
+// Callers must hold b.mu.
+func (b *SMBus) transfer(msgs []I2CMessage) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	rawMsgs := make([]i2cMsg, len(msgs))
+	for i := range msgs {
+		if len(msgs[i].Data) == 0 {
+			return fmt.Errorf("Message %d has no data buffer", i)
+		}
+		wireLen := uint16(len(msgs[i].Data))
+		if msgs[i].initialRecvLen != 0 {
+			wireLen = msgs[i].initialRecvLen
+		}
+		rawMsgs[i] = i2cMsg{
+			addr:  msgs[i].Addr,
+			flags: msgs[i].Flags,
+			len:   wireLen,
+			buf:   unsafe.Pointer(&msgs[i].Data[0]),
+		}
+	}
+	data := i2cRdwrIoctlData{
+		msgs:  unsafe.Pointer(&rawMsgs[0]),
+		nmsgs: uint32(len(rawMsgs)),
+	}
+	e := ioctl(b.caller, b.fd, I2CRDWR, unsafe.Pointer(&data))
+	runtime.KeepAlive(msgs)
+	runtime.KeepAlive(rawMsgs)
+	runtime.KeepAlive(data)
+	if e != nil {
+		return fmt.Errorf("Error performing I2C_RDWR transfer: %w", e)
+	}
+	return nil
+}
+
+// Mirrors struct i2c_smbus_ioctl_data from uapi/linux/i2c-dev.h. The data
+// pointer is expected to point at a uint8, uint16, or a
+// [I2CSMBusBlockMax+2]byte, depending on size.
+type i2cSMBusIoctlData struct {
+	readWrite uint8
+	command   uint8
+	size      uint32
+	data      unsafe.Pointer
+}
+
+// Performs a single native I2C_SMBUS ioctl transaction.
+func (b *SMBus) smbusAccess(readWrite uint8, command uint8, size uint32, data unsafe.Pointer) error {
+	args := i2cSMBusIoctlData{
+		readWrite: readWrite,
+		command:   command,
+		size:      size,
+		data:      data,
+	}
+	e := ioctl(b.caller, b.fd, I2CSMBus, unsafe.Pointer(&args))
+	runtime.KeepAlive(args)
+	if e != nil {
+		return fmt.Errorf("Error performing I2C_SMBUS ioctl: %w", e)
+	}
+	return nil
+}
+
+// Returns true if SMBus operations requiring the given capability bits
+// should go through the I2CRDWR emulation path rather than the native
+// I2C_SMBUS ioctl, either because the adapter doesn't advertise the
+// capability or because PreferEmulation was set.
+func (b *SMBus) useEmulation(requiredFuncs uint32) bool {
+	return b.PreferEmulation || !b.Funcs.BitsSet(requiredFuncs)
+}
+
+// Reads a single byte from the device at addr, without a command/register
+// byte. Falls back to I2CRDWR emulation on adapters that don't support the
+// native SMBus "receive byte" transaction.
+func (b *SMBus) ReadByte(addr uint16) (uint8, error) {
+	var value uint8
+	e := b.Do(addr, func(d *Device) error {
+		var doErr error
+		value, doErr = d.ReadByte()
+		return doErr
+	})
+	return value, e
+}
+
+// Like SMBus.ReadByte, but for use within a Do call.
+func (d *Device) ReadByte() (uint8, error) {
+	return d.bus.readByte(d.addr)
+}
+
+func (b *SMBus) readByte(addr uint16) (uint8, error) {
+	if !b.useEmulation(SMBusReadByteFlag) {
+		var value uint8
+		e := b.smbusAccess(I2CSMBusRead, 0, I2CSMBusByte, unsafe.Pointer(&value))
+		if e != nil {
+			return 0, e
+		}
+		return value, nil
+	}
+	n := 1
+	if b.pec != 0 {
+		n++
+	}
+	result := make([]byte, n)
+	e := b.transfer([]I2CMessage{{Addr: addr, Flags: I2CMRD, Data: result}})
+	if e != nil {
+		return 0, fmt.Errorf("Error emulating ReadByte: %w", e)
+	}
+	result, e = b.checkReadPEC(addr, nil, result)
+	if e != nil {
+		return 0, e
+	}
+	return result[0], nil
+}
+
+// Writes a single byte to the device at addr, without a command/register
+// byte. Falls back to I2CRDWR emulation on adapters that don't support the
+// native SMBus "send byte" transaction.
+func (b *SMBus) WriteByte(addr uint16, value uint8) error {
+	return b.Do(addr, func(d *Device) error {
+		return d.WriteByte(value)
+	})
+}
+
+// Like SMBus.WriteByte, but for use within a Do call.
+func (d *Device) WriteByte(value uint8) error {
+	return d.bus.writeByte(d.addr, value)
+}
+
+func (b *SMBus) writeByte(addr uint16, value uint8) error {
+	if !b.useEmulation(SMBusWriteByteFlag) {
+		return b.smbusAccess(I2CSMBusWrite, value, I2CSMBusByte, nil)
+	}
+	data := b.appendPEC(addr, []byte{value})
+	e := b.transfer([]I2CMessage{{Addr: addr, Data: data}})
+	if e != nil {
+		return fmt.Errorf("Error emulating WriteByte: %w", e)
+	}
+	return nil
+}
+
+// Reads a single byte from the given command/register on the device at
+// addr. Falls back to I2CRDWR emulation on adapters that don't support the
+// native SMBus "read byte data" transaction.
+func (b *SMBus) ReadByteData(addr uint16, command uint8) (uint8, error) {
+	var value uint8
+	e := b.Do(addr, func(d *Device) error {
+		var doErr error
+		value, doErr = d.ReadByteData(command)
+		return doErr
+	})
+	return value, e
+}
+
+// Like SMBus.ReadByteData, but for use within a Do call.
+func (d *Device) ReadByteData(command uint8) (uint8, error) {
+	return d.bus.readByteData(d.addr, command)
+}
+
+func (b *SMBus) readByteData(addr uint16, command uint8) (uint8, error) {
+	if !b.useEmulation(SMBusReadByteDataFlag) {
+		var value uint8
+		e := b.smbusAccess(I2CSMBusRead, command, I2CSMBusByteData, unsafe.Pointer(&value))
+		if e != nil {
+			return 0, e
+		}
+		return value, nil
+	}
+	return b.emulatedReadByteData(addr, command)
+}
+
+// The I2CRDWR-based fallback for ReadByteData.
+func (b *SMBus) emulatedReadByteData(addr uint16, command uint8) (uint8, error) {
+	n := 1
+	if b.pec != 0 {
+		n++
+	}
+	result := make([]byte, n)
+	msgs := []I2CMessage{
+		{Addr: addr, Data: []byte{command}},
+		{Addr: addr, Flags: I2CMRD, Data: result},
+	}
+	e := b.transfer(msgs)
+	if e != nil {
+		return 0, fmt.Errorf("Error emulating ReadByteData: %w", e)
+	}
+	result, e = b.checkReadPEC(addr, []byte{command}, result)
+	if e != nil {
+		return 0, e
+	}
+	return result[0], nil
+}
+
+// Writes a single byte to the given command/register on the device at addr.
+// Falls back to I2CRDWR emulation on adapters that don't support the native
+// SMBus "write byte data" transaction.
+func (b *SMBus) WriteByteData(addr uint16, command uint8, value uint8) error {
+	return b.Do(addr, func(d *Device) error {
+		return d.WriteByteData(command, value)
+	})
+}
+
+// Like SMBus.WriteByteData, but for use within a Do call.
+func (d *Device) WriteByteData(command uint8, value uint8) error {
+	return d.bus.writeByteData(d.addr, command, value)
+}
+
+func (b *SMBus) writeByteData(addr uint16, command uint8, value uint8) error {
+	if !b.useEmulation(SMBusWriteByteDataFlag) {
+		return b.smbusAccess(I2CSMBusWrite, command, I2CSMBusByteData, unsafe.Pointer(&value))
+	}
+	return b.emulatedWriteByteData(addr, command, value)
+}
+
+// The I2CRDWR-based fallback for WriteByteData.
+func (b *SMBus) emulatedWriteByteData(addr uint16, command uint8, value uint8) error {
+	data := b.appendPEC(addr, []byte{command, value})
+	msgs := []I2CMessage{{Addr: addr, Data: data}}
+	e := b.transfer(msgs)
+	if e != nil {
+		return fmt.Errorf("Error emulating WriteByteData: %w", e)
+	}
+	return nil
+}
+
+// Reads a 16-bit word (little-endian, per the SMBus spec) from the given
+// command/register on the device at addr. Falls back to I2CRDWR emulation
+// on adapters that don't support the native SMBus "read word data"
+// transaction.
+func (b *SMBus) ReadWordData(addr uint16, command uint8) (uint16, error) {
+	var value uint16
+	e := b.Do(addr, func(d *Device) error {
+		var doErr error
+		value, doErr = d.ReadWordData(command)
+		return doErr
+	})
+	return value, e
+}
+
+// Like SMBus.ReadWordData, but for use within a Do call.
+func (d *Device) ReadWordData(command uint8) (uint16, error) {
+	return d.bus.readWordData(d.addr, command)
+}
+
+func (b *SMBus) readWordData(addr uint16, command uint8) (uint16, error) {
+	if !b.useEmulation(SMBusReadWordDataFlag) {
+		var value uint16
+		e := b.smbusAccess(I2CSMBusRead, command, I2CSMBusWordData, unsafe.Pointer(&value))
+		if e != nil {
+			return 0, e
+		}
+		return value, nil
+	}
+	return b.emulatedReadWordData(addr, command)
+}
+
+// The I2CRDWR-based fallback for ReadWordData.
+func (b *SMBus) emulatedReadWordData(addr uint16, command uint8) (uint16, error) {
+	n := 2
+	if b.pec != 0 {
+		n++
+	}
+	result := make([]byte, n)
+	msgs := []I2CMessage{
+		{Addr: addr, Data: []byte{command}},
+		{Addr: addr, Flags: I2CMRD, Data: result},
+	}
+	e := b.transfer(msgs)
+	if e != nil {
+		return 0, fmt.Errorf("Error emulating ReadWordData: %w", e)
+	}
+	result, e = b.checkReadPEC(addr, []byte{command}, result)
+	if e != nil {
+		return 0, e
+	}
+	return uint16(result[0]) | (uint16(result[1]) << 8), nil
+}
+
+// Writes a 16-bit word (little-endian, per the SMBus spec) to the given
+// command/register on the device at addr. Falls back to I2CRDWR emulation
+// on adapters that don't support the native SMBus "write word data"
+// transaction.
+func (b *SMBus) WriteWordData(addr uint16, command uint8, value uint16) error {
+	return b.Do(addr, func(d *Device) error {
+		return d.WriteWordData(command, value)
+	})
+}
+
+// Like SMBus.WriteWordData, but for use within a Do call.
+func (d *Device) WriteWordData(command uint8, value uint16) error {
+	return d.bus.writeWordData(d.addr, command, value)
+}
+
+func (b *SMBus) writeWordData(addr uint16, command uint8, value uint16) error {
+	if !b.useEmulation(SMBusWriteWordDataFlag) {
+		return b.smbusAccess(I2CSMBusWrite, command, I2CSMBusWordData, unsafe.Pointer(&value))
+	}
+	return b.emulatedWriteWordData(addr, command, value)
+}
+
+// The I2CRDWR-based fallback for WriteWordData.
+func (b *SMBus) emulatedWriteWordData(addr uint16, command uint8, value uint16) error {
+	data := b.appendPEC(addr, []byte{command, uint8(value), uint8(value >> 8)})
+	msgs := []I2CMessage{{Addr: addr, Data: data}}
+	e := b.transfer(msgs)
+	if e != nil {
+		return fmt.Errorf("Error emulating WriteWordData: %w", e)
+	}
+	return nil
+}
+
+// Reads a variable-length block (up to I2CSMBusBlockMax bytes) from the
+// given command/register on the device at addr; the returned slice is sized
+// to the device-reported length. Falls back to I2CRDWR emulation, using
+// I2CMRecvLen, on adapters that don't support the native SMBus "read block
+// data" transaction.
+func (b *SMBus) ReadBlockData(addr uint16, command uint8) ([]byte, error) {
+	var result []byte
+	e := b.Do(addr, func(d *Device) error {
+		var doErr error
+		result, doErr = d.ReadBlockData(command)
+		return doErr
+	})
+	return result, e
+}
+
+// Like SMBus.ReadBlockData, but for use within a Do call.
+func (d *Device) ReadBlockData(command uint8) ([]byte, error) {
+	return d.bus.readBlockData(d.addr, command)
+}
+
+func (b *SMBus) readBlockData(addr uint16, command uint8) ([]byte, error) {
+	if !b.useEmulation(SMBusReadBlockDataFlag) {
+		var block [I2CSMBusBlockMax + 2]byte
+		e := b.smbusAccess(I2CSMBusRead, command, I2CSMBusBlockData, unsafe.Pointer(&block[0]))
+		if e != nil {
+			return nil, e
+		}
+		n := int(block[0])
+		if n > I2CSMBusBlockMax {
+			n = I2CSMBusBlockMax
+		}
+		result := make([]byte, n)
+		copy(result, block[1:1+n])
+		return result, nil
+	}
+	return b.emulatedReadBlockData(addr, command)
+}
+
+// The I2CRDWR-based fallback for ReadBlockData.
+func (b *SMBus) emulatedReadBlockData(addr uint16, command uint8) ([]byte, error) {
+	sz := I2CSMBusBlockMax + 1
+	if b.pec != 0 {
+		sz++
+	}
+	result := make([]byte, sz)
+	recvLen := uint16(1)
+	if b.pec != 0 {
+		recvLen = 2
+	}
+	msgs := []I2CMessage{
+		{Addr: addr, Data: []byte{command}},
+		{Addr: addr, Flags: I2CMRD | I2CMRecvLen, Data: result, initialRecvLen: recvLen},
+	}
+	e := b.transfer(msgs)
+	if e != nil {
+		return nil, fmt.Errorf("Error emulating ReadBlockData: %w", e)
+	}
+	n := int(result[0])
+	if n > I2CSMBusBlockMax {
+		n = I2CSMBusBlockMax
+	}
+	wireLen := 1 + n
+	if b.pec != 0 {
+		wireLen++
+	}
+	wire, e := b.checkReadPEC(addr, []byte{command}, result[:wireLen])
+	if e != nil {
+		return nil, e
+	}
+	return wire[1 : 1+n], nil
+}
+
+// Writes a variable-length block (up to I2CSMBusBlockMax bytes) to the
+// given command/register on the device at addr. Falls back to I2CRDWR
+// emulation on adapters that don't support the native SMBus "write block
+// data" transaction.
+func (b *SMBus) WriteBlockData(addr uint16, command uint8, data []byte) error {
+	return b.Do(addr, func(d *Device) error {
+		return d.WriteBlockData(command, data)
+	})
+}
+
+// Like SMBus.WriteBlockData, but for use within a Do call.
+func (d *Device) WriteBlockData(command uint8, data []byte) error {
+	return d.bus.writeBlockData(d.addr, command, data)
+}
+
+func (b *SMBus) writeBlockData(addr uint16, command uint8, data []byte) error {
+	if len(data) > I2CSMBusBlockMax {
+		return fmt.Errorf("Block data too long: got %d bytes, max is %d",
+			len(data), I2CSMBusBlockMax)
+	}
+	if !b.useEmulation(SMBusWriteBlockDataFlag) {
+		var block [I2CSMBusBlockMax + 2]byte
+		block[0] = byte(len(data))
+		copy(block[1:], data)
+		return b.smbusAccess(I2CSMBusWrite, command, I2CSMBusBlockData, unsafe.Pointer(&block[0]))
+	}
+	return b.emulatedWriteBlockData(addr, command, data)
+}
+
+// The I2CRDWR-based fallback for WriteBlockData.
+func (b *SMBus) emulatedWriteBlockData(addr uint16, command uint8, data []byte) error {
+	buf := make([]byte, 0, len(data)+2)
+	buf = append(buf, command, byte(len(data)))
+	buf = append(buf, data...)
+	buf = b.appendPEC(addr, buf)
+	e := b.transfer([]I2CMessage{{Addr: addr, Data: buf}})
+	if e != nil {
+		return fmt.Errorf("Error emulating WriteBlockData: %w", e)
+	}
+	return nil
+}
+
+// Writes a 16-bit word to the given command/register, and returns the
+// 16-bit word the device sends back in the same transaction. Falls back to
+// I2CRDWR emulation on adapters that don't support the native SMBus
+// "process call" transaction.
+func (b *SMBus) ProcessCall(addr uint16, command uint8, value uint16) (uint16, error) {
+	var result uint16
+	e := b.Do(addr, func(d *Device) error {
+		var doErr error
+		result, doErr = d.ProcessCall(command, value)
+		return doErr
+	})
+	return result, e
+}
+
+// Like SMBus.ProcessCall, but for use within a Do call.
+func (d *Device) ProcessCall(command uint8, value uint16) (uint16, error) {
+	return d.bus.processCall(d.addr, command, value)
+}
+
+func (b *SMBus) processCall(addr uint16, command uint8, value uint16) (uint16, error) {
+	if !b.useEmulation(SMBusProcCallFlag) {
+		data := value
+		e := b.smbusAccess(I2CSMBusWrite, command, I2CSMBusProcCall, unsafe.Pointer(&data))
+		if e != nil {
+			return 0, e
+		}
+		return data, nil
+	}
+	return b.emulatedProcessCall(addr, command, value)
+}
+
+// The I2CRDWR-based fallback for ProcessCall.
+func (b *SMBus) emulatedProcessCall(addr uint16, command uint8, value uint16) (uint16, error) {
+	written := []byte{command, uint8(value), uint8(value >> 8)}
+	n := 2
+	if b.pec != 0 {
+		n++
+	}
+	result := make([]byte, n)
+	msgs := []I2CMessage{
+		{Addr: addr, Data: written},
+		{Addr: addr, Flags: I2CMRD, Data: result},
+	}
+	e := b.transfer(msgs)
+	if e != nil {
+		return 0, fmt.Errorf("Error emulating ProcessCall: %w", e)
+	}
+	result, e = b.checkReadPEC(addr, written, result)
+	if e != nil {
+		return 0, e
+	}
+	return uint16(result[0]) | (uint16(result[1]) << 8), nil
+}
+
+// Writes a variable-length block to the given command/register, and returns
+// the variable-length block the device sends back in the same transaction.
+// Falls back to I2CRDWR emulation, using I2CMRecvLen, on adapters that
+// don't support the native SMBus "block process call" transaction.
+func (b *SMBus) BlockProcessCall(addr uint16, command uint8, data []byte) ([]byte, error) {
+	var result []byte
+	e := b.Do(addr, func(d *Device) error {
+		var doErr error
+		result, doErr = d.BlockProcessCall(command, data)
+		return doErr
+	})
+	return result, e
+}
+
+// Like SMBus.BlockProcessCall, but for use within a Do call.
+func (d *Device) BlockProcessCall(command uint8, data []byte) ([]byte, error) {
+	return d.bus.blockProcessCall(d.addr, command, data)
+}
+
+func (b *SMBus) blockProcessCall(addr uint16, command uint8, data []byte) ([]byte, error) {
+	if len(data) > I2CSMBusBlockMax {
+		return nil, fmt.Errorf("Block data too long: got %d bytes, max is %d",
+			len(data), I2CSMBusBlockMax)
+	}
+	if !b.useEmulation(SMBusBlockProcCallFlag) {
+		var block [I2CSMBusBlockMax + 2]byte
+		block[0] = byte(len(data))
+		copy(block[1:], data)
+		e := b.smbusAccess(I2CSMBusWrite, command, I2CSMBusBlockProcCall, unsafe.Pointer(&block[0]))
+		if e != nil {
+			return nil, e
+		}
+		n := int(block[0])
+		if n > I2CSMBusBlockMax {
+			n = I2CSMBusBlockMax
+		}
+		result := make([]byte, n)
+		copy(result, block[1:1+n])
+		return result, nil
+	}
+	return b.emulatedBlockProcessCall(addr, command, data)
+}
+
+// The I2CRDWR-based fallback for BlockProcessCall.
+func (b *SMBus) emulatedBlockProcessCall(addr uint16, command uint8, data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data)+2)
+	out = append(out, command, byte(len(data)))
+	out = append(out, data...)
+	written := append([]byte{}, out...)
+	sz := I2CSMBusBlockMax + 1
+	if b.pec != 0 {
+		sz++
+	}
+	in := make([]byte, sz)
+	recvLen := uint16(1)
+	if b.pec != 0 {
+		recvLen = 2
+	}
+	msgs := []I2CMessage{
+		{Addr: addr, Data: out},
+		{Addr: addr, Flags: I2CMRD | I2CMRecvLen, Data: in, initialRecvLen: recvLen},
+	}
+	e := b.transfer(msgs)
+	if e != nil {
+		return nil, fmt.Errorf("Error emulating BlockProcessCall: %w", e)
+	}
+	n := int(in[0])
+	if n > I2CSMBusBlockMax {
+		n = I2CSMBusBlockMax
+	}
+	wireLen := 1 + n
+	if b.pec != 0 {
+		wireLen++
+	}
+	wire, e := b.checkReadPEC(addr, written, in[:wireLen])
+	if e != nil {
+		return nil, e
+	}
+	return wire[1 : 1+n], nil
+}
+
+// Reads up to I2CSMBusBlockMax bytes from command via the native I2C_SMBUS
+// "I2C block data" transaction (I2CSMBusI2CBlockData), falling back to
+// I2CRDWR emulation on adapters that don't support it. Unlike
+// readBlockData, the caller specifies how many bytes to read rather than
+// trusting a length byte reported by the device; used internally by
+// ReadBlockAt for devices that respond to a plain register read rather than
+// a self-describing SMBus block.
+func (b *SMBus) readI2CBlockData(addr uint16, command uint8, n int) ([]byte, error) {
+	if n > I2CSMBusBlockMax {
+		n = I2CSMBusBlockMax
+	}
+	if !b.useEmulation(SMBusReadI2CBlockFlag) {
+		var block [I2CSMBusBlockMax + 2]byte
+		block[0] = byte(n)
+		e := b.smbusAccess(I2CSMBusRead, command, I2CSMBusI2CBlockData, unsafe.Pointer(&block[0]))
+		if e != nil {
+			return nil, e
+		}
+		result := make([]byte, n)
+		copy(result, block[1:1+n])
+		return result, nil
+	}
+	sz := n
+	if b.pec != 0 {
+		sz++
+	}
+	result := make([]byte, sz)
+	msgs := []I2CMessage{
+		{Addr: addr, Data: []byte{command}},
+		{Addr: addr, Flags: I2CMRD, Data: result},
+	}
+	e := b.transfer(msgs)
+	if e != nil {
+		return nil, fmt.Errorf("Error emulating I2C block read: %w", e)
+	}
+	result, e = b.checkReadPEC(addr, []byte{command}, result)
+	if e != nil {
+		return nil, e
+	}
+	return result, nil
+}
+
+// Writes data (up to I2CSMBusBlockMax bytes) to command via the native
+// I2C_SMBUS "I2C block data" transaction, falling back to I2CRDWR emulation
+// on adapters that don't support it. Used internally by WriteBlockAt.
+func (b *SMBus) writeI2CBlockData(addr uint16, command uint8, data []byte) error {
+	if len(data) > I2CSMBusBlockMax {
+		return fmt.Errorf("Block data too long: got %d bytes, max is %d",
+			len(data), I2CSMBusBlockMax)
+	}
+	if !b.useEmulation(SMBusWriteI2CBlockFlag) {
+		var block [I2CSMBusBlockMax + 2]byte
+		block[0] = byte(len(data))
+		copy(block[1:], data)
+		return b.smbusAccess(I2CSMBusWrite, command, I2CSMBusI2CBlockData, unsafe.Pointer(&block[0]))
+	}
+	buf := make([]byte, 0, len(data)+1)
+	buf = append(buf, command)
+	buf = append(buf, data...)
+	buf = b.appendPEC(addr, buf)
+	e := b.transfer([]I2CMessage{{Addr: addr, Data: buf}})
+	if e != nil {
+		return fmt.Errorf("Error emulating I2C block write: %w", e)
+	}
+	return nil
+}
+
+// Reads n bytes starting at register offset on the device at addr, issuing
+// repeated reads of at most chunk bytes (itself capped at
+// I2CSMBusBlockMax), sleeping delay between chunks and advancing offset by
+// the number of bytes read each pass. This is a friendlier surface than
+// ReadBlockData for devices like EEPROMs or ADC FIFOs that expect a raw
+// register offset and byte count rather than a self-describing SMBus
+// block. chunk <= 0 means use the largest chunk size the adapter allows.
+func (b *SMBus) ReadBlockAt(addr uint16, offset uint8, n int, chunk int, delay time.Duration) ([]byte, error) {
+	var result []byte
+	e := b.Do(addr, func(d *Device) error {
+		var doErr error
+		result, doErr = d.ReadBlockAt(offset, n, chunk, delay)
+		return doErr
+	})
+	return result, e
+}
+
+// Like SMBus.ReadBlockAt, but for use within a Do call.
+func (d *Device) ReadBlockAt(offset uint8, n int, chunk int, delay time.Duration) ([]byte, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("Invalid read length: %d", n)
+	}
+	if chunk <= 0 || chunk > I2CSMBusBlockMax {
+		chunk = I2CSMBusBlockMax
+	}
+	reg := offset
+	result := make([]byte, 0, n)
+	for len(result) < n {
+		want := chunk
+		if remaining := n - len(result); want > remaining {
+			want = remaining
+		}
+		part, e := d.bus.readI2CBlockData(d.addr, reg, want)
+		if e != nil {
+			return nil, fmt.Errorf("Error reading block at offset 0x%02x: %w", reg, e)
+		}
+		result = append(result, part...)
+		reg += uint8(len(part))
+		if len(result) < n && delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+	return result, nil
+}
+
+// Writes data to the device at addr, starting at register offset, issuing
+// repeated writes of at most chunk bytes (itself capped at
+// I2CSMBusBlockMax), sleeping delay between chunks and advancing offset by
+// the number of bytes written each pass. The symmetric counterpart to
+// ReadBlockAt. chunk <= 0 means use the largest chunk size the adapter
+// allows.
+func (b *SMBus) WriteBlockAt(addr uint16, offset uint8, data []byte, chunk int, delay time.Duration) error {
+	return b.Do(addr, func(d *Device) error {
+		return d.WriteBlockAt(offset, data, chunk, delay)
+	})
+}
+
+// Like SMBus.WriteBlockAt, but for use within a Do call.
+func (d *Device) WriteBlockAt(offset uint8, data []byte, chunk int, delay time.Duration) error {
+	if chunk <= 0 || chunk > I2CSMBusBlockMax {
+		chunk = I2CSMBusBlockMax
+	}
+	reg := offset
+	for i := 0; i < len(data); i += chunk {
+		end := i + chunk
+		if end > len(data) {
+			end = len(data)
+		}
+		part := data[i:end]
+		e := d.bus.writeI2CBlockData(d.addr, reg, part)
+		if e != nil {
+			return fmt.Errorf("Error writing block at offset 0x%02x: %w", reg, e)
+		}
+		reg += uint8(len(part))
+		if end < len(data) && delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+	return nil
 }
\ No newline at end of file
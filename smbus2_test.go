@@ -0,0 +1,458 @@
+package smbus2_go
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// fakeSystemCaller is a SystemCaller test double. It lets tests inject
+// faults on individual ioctl commands, or supply canned kernel responses,
+// without talking to a real I2C bus.
+type fakeSystemCaller struct {
+	// Returned by the I2C_FUNCS ioctl in Ioctl.
+	funcs uint32
+	// Non-zero errnos to return from specific commands, to simulate kernel
+	// or hardware failures.
+	funcsErr syscall.Errno
+	slaveErr syscall.Errno
+	smbusErr syscall.Errno
+	// Runs against the raw i2c_smbus_ioctl_data for I2C_SMBUS ioctls, so
+	// tests can fill in the data the "device" returns.
+	smbusHandler func(args *i2cSMBusIoctlData)
+	// Copied into the buffer of the first read (I2CMRD) message of an
+	// I2CRDWR transfer, simulating what a device would have returned.
+	rdwrReadData []byte
+	// The i2c_msg.len the most recent I2CRDWR ioctl saw for each message,
+	// in message order. Lets tests assert on what was actually put on
+	// the wire, independent of how large the backing buffer was.
+	lastMsgLens []uint16
+	// The slave address most recently set via I2C_SLAVE/I2C_SLAVE_FORCE.
+	// Unsynchronized: TestDoSerializesSlaveSelection relies on Do's
+	// locking to make that safe, and on the race detector to catch it if
+	// that locking is ever broken.
+	currentSlaveAddr uint16
+	// Runs on each I2C_SMBUS ioctl, before smbusHandler, with the slave
+	// address selected for it, so tests can check an operation never runs against the wrong
+	// device.
+	onSMBusAccess func(addr uint16, args *i2cSMBusIoctlData)
+}
+
+func (f *fakeSystemCaller) Open(path string, flags int, mode uint32) (int, error) {
+	return 3, nil
+}
+
+func (f *fakeSystemCaller) Close(fd int) error {
+	return nil
+}
+
+func (f *fakeSystemCaller) Ioctl(fd int, cmd uintptr, arg unsafe.Pointer) syscall.Errno {
+	switch cmd {
+	case I2CFuncs:
+		if f.funcsErr != 0 {
+			return f.funcsErr
+		}
+		*(*uint32)(arg) = f.funcs
+		return 0
+	case I2CSMBus:
+		if f.smbusErr != 0 {
+			return f.smbusErr
+		}
+		args := (*i2cSMBusIoctlData)(arg)
+		if f.onSMBusAccess != nil {
+			f.onSMBusAccess(f.currentSlaveAddr, args)
+		}
+		if f.smbusHandler != nil {
+			f.smbusHandler(args)
+		}
+		return 0
+	case I2CRDWR:
+		data := (*i2cRdwrIoctlData)(arg)
+		msgs := unsafe.Slice((*i2cMsg)(data.msgs), int(data.nmsgs))
+		f.lastMsgLens = make([]uint16, len(msgs))
+		for i := range msgs {
+			f.lastMsgLens[i] = msgs[i].len
+		}
+		for i := range msgs {
+			if msgs[i].flags&I2CMRD == 0 {
+				continue
+			}
+			// A real I2C_M_RECV_LEN read's i2c_msg.len is only the
+			// initial one-or-two-byte budget; the buffer it points at
+			// is still sized for a full block, so view it by the
+			// canned response size here rather than by len.
+			n := int(msgs[i].len)
+			if msgs[i].flags&I2CMRecvLen != 0 {
+				n = len(f.rdwrReadData)
+			}
+			buf := unsafe.Slice((*byte)(msgs[i].buf), n)
+			copy(buf, f.rdwrReadData)
+			return 0
+		}
+		return 0
+	}
+	return 0
+}
+
+func (f *fakeSystemCaller) IoctlInt(fd int, cmd uintptr, arg int) syscall.Errno {
+	switch cmd {
+	case I2CSlave, I2CSlaveForce:
+		if f.slaveErr != 0 {
+			return f.slaveErr
+		}
+		f.currentSlaveAddr = uint16(arg)
+	}
+	return 0
+}
+
+func (f *fakeSystemCaller) Read(fd int, buf []byte) (int, error) {
+	return len(buf), nil
+}
+
+func (f *fakeSystemCaller) Write(fd int, buf []byte) (int, error) {
+	return len(buf), nil
+}
+
+// Builds an SMBus backed by caller, for use within a single test.
+func newTestBus(t *testing.T, caller *fakeSystemCaller) *SMBus {
+	t.Helper()
+	prev := DefaultSystemCaller
+	DefaultSystemCaller = caller
+	t.Cleanup(func() { DefaultSystemCaller = prev })
+	bus, e := NewSMBus(0)
+	if e != nil {
+		t.Fatalf("NewSMBus failed: %v", e)
+	}
+	return bus
+}
+
+// The I2C_FUNCS ioctl is the first ioctl NewSMBusWithPath makes; a
+// failure there must surface as a constructor error rather than leaving
+// Funcs zeroed and silently wrong.
+func TestFuncsIoctlFault(t *testing.T) {
+	prev := DefaultSystemCaller
+	DefaultSystemCaller = &fakeSystemCaller{funcsErr: syscall.EIO}
+	defer func() { DefaultSystemCaller = prev }()
+	_, e := NewSMBus(0)
+	if e == nil {
+		t.Fatalf("expected an error when I2C_FUNCS fails, got nil")
+	}
+}
+
+// Table-driven over the remaining two kernel entry points SystemCaller
+// exists to make fakeable: I2C_SLAVE (address selection in Do) and
+// I2C_SMBUS (the native protocol ioctl).
+func TestKernelFaultInjection(t *testing.T) {
+	tests := []struct {
+		name   string
+		caller *fakeSystemCaller
+		run    func(bus *SMBus) error
+	}{
+		{
+			name:   "I2C_SLAVE failure surfaces from Do",
+			caller: &fakeSystemCaller{funcs: I2CFlag, slaveErr: syscall.ENXIO},
+			run: func(bus *SMBus) error {
+				return bus.Do(0x50, func(d *Device) error { return nil })
+			},
+		},
+		{
+			name:   "I2C_SMBUS failure surfaces from ReadByteData",
+			caller: &fakeSystemCaller{funcs: I2CFlag | SMBusReadByteDataFlag, smbusErr: syscall.EREMOTEIO},
+			run: func(bus *SMBus) error {
+				_, e := bus.ReadByteData(0x50, 0x00)
+				return e
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bus := newTestBus(t, test.caller)
+			if e := test.run(bus); e == nil {
+				t.Fatalf("expected an error, got nil")
+			}
+		})
+	}
+}
+
+// Regression test: the native I2C_SMBUS ReadBlockData path must clamp a
+// device-reported length byte to I2CSMBusBlockMax rather than slicing the
+// fixed-size on-stack buffer out of range.
+func TestReadBlockDataClampsCorruptLength(t *testing.T) {
+	caller := &fakeSystemCaller{
+		funcs: I2CFlag | SMBusReadBlockDataFlag,
+		smbusHandler: func(args *i2cSMBusIoctlData) {
+			block := (*[I2CSMBusBlockMax + 2]byte)(args.data)
+			block[0] = 200 // out-of-spec length; must be clamped, not panic
+			for i := 1; i <= I2CSMBusBlockMax; i++ {
+				block[i] = byte(i)
+			}
+		},
+	}
+	bus := newTestBus(t, caller)
+	result, e := bus.ReadBlockData(0x50, 0x10)
+	if e != nil {
+		t.Fatalf("ReadBlockData failed: %v", e)
+	}
+	if len(result) != I2CSMBusBlockMax {
+		t.Fatalf("expected result clamped to %d bytes, got %d", I2CSMBusBlockMax, len(result))
+	}
+}
+
+// Regression test: an I2CMRecvLen read's i2c_msg.len must be the small
+// initial budget (1, or 2 with PEC) the kernel contract requires, not the
+// size of the oversized buffer backing Data. Real bit-banged drivers use
+// that initial len as the byte-count budget for the read loop, so sending
+// a buffer-sized len would tell the bus to clock far more bytes than the
+// device ever sends.
+func TestEmulatedBlockReadsSendRecvLenBudget(t *testing.T) {
+	tests := []struct {
+		name        string
+		pec         uint32
+		wantLen     uint16
+		rdwrReadLen int
+	}{
+		{name: "no PEC", pec: 0, wantLen: 1, rdwrReadLen: 4},
+		{name: "with PEC", pec: 1, wantLen: 2, rdwrReadLen: 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			caller := &fakeSystemCaller{
+				funcs:        I2CFlag, // no native block-data support -> emulation path
+				rdwrReadData: make([]byte, test.rdwrReadLen),
+			}
+			caller.rdwrReadData[0] = 3 // device-reported length
+			caller.rdwrReadData[1] = 0xaa
+			caller.rdwrReadData[2] = 0xbb
+			caller.rdwrReadData[3] = 0xcc
+			if test.pec != 0 {
+				// CRC-8 of {addr=0x50 Wr, command=0x10, addr=0x50 Rd,
+				// length=3, 0xaa, 0xbb, 0xcc}, as a real PEC-enabled
+				// device would compute it for this transaction.
+				caller.rdwrReadData[4] = 0x63
+			}
+			bus := newTestBus(t, caller)
+			bus.pec = test.pec
+
+			result, e := bus.ReadBlockData(0x50, 0x10)
+			if e != nil {
+				t.Fatalf("ReadBlockData failed: %v", e)
+			}
+			if len(caller.lastMsgLens) != 2 {
+				t.Fatalf("expected 2 raw messages (write command, RECV_LEN read), got %d",
+					len(caller.lastMsgLens))
+			}
+			if caller.lastMsgLens[1] != test.wantLen {
+				t.Fatalf("expected RECV_LEN read to declare len=%d, got %d",
+					test.wantLen, caller.lastMsgLens[1])
+			}
+			if len(result) != 3 || result[0] != 0xaa || result[1] != 0xbb || result[2] != 0xcc {
+				t.Fatalf("unexpected result: %v", result)
+			}
+		})
+	}
+}
+
+// Regression test: a plain ReadByte ("Receive Byte") has no write phase on
+// the wire at all, so its PEC must cover only addr+Rd and the data byte,
+// not a phantom addr+Wr byte.
+func TestReadBytePECReceiveByte(t *testing.T) {
+	caller := &fakeSystemCaller{
+		funcs: I2CFlag, // no native "receive byte" support -> emulation path
+		// CRC-8 of {addr=0x50 with R/W=1, data=0x42}, as a real device
+		// would compute it for a Receive Byte transaction.
+		rdwrReadData: []byte{0x42, 0xc4},
+	}
+	bus := newTestBus(t, caller)
+	bus.pec = 1
+	value, e := bus.ReadByte(0x50)
+	if e != nil {
+		t.Fatalf("ReadByte failed: %v", e)
+	}
+	if value != 0x42 {
+		t.Fatalf("expected 0x42, got 0x%02x", value)
+	}
+}
+
+// Regression test: SetPEC and EnablePEC should both report the unsupported
+// case the same way, so callers can use errors.Is uniformly.
+func TestSetPECUnsupported(t *testing.T) {
+	bus := newTestBus(t, &fakeSystemCaller{funcs: I2CFlag})
+	e := bus.EnablePEC(true)
+	if e != ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported from EnablePEC, got %v", e)
+	}
+	e = bus.Do(0x50, func(d *Device) error {
+		return d.SetPEC(true)
+	})
+	if e != ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported from Device.SetPEC, got %v", e)
+	}
+}
+
+// Transfer's whole point is write-then-read transactions the SMBus protocol
+// can't express: a single combined I2CRDWR call with a write message
+// followed by a read message, the read's buffer filled in place.
+func TestTransferWriteThenRead(t *testing.T) {
+	caller := &fakeSystemCaller{
+		funcs:        I2CFlag,
+		rdwrReadData: []byte{0xde, 0xad},
+	}
+	bus := newTestBus(t, caller)
+	readBuf := make([]byte, 2)
+	msgs := []I2CMessage{
+		{Addr: 0x50, Data: []byte{0x01, 0x02}},
+		{Addr: 0x50, Flags: I2CMRD, Data: readBuf},
+	}
+	if e := bus.Transfer(msgs); e != nil {
+		t.Fatalf("Transfer failed: %v", e)
+	}
+	if len(caller.lastMsgLens) != 2 {
+		t.Fatalf("expected 2 raw messages, got %d", len(caller.lastMsgLens))
+	}
+	if caller.lastMsgLens[0] != 2 {
+		t.Fatalf("expected write message len=2, got %d", caller.lastMsgLens[0])
+	}
+	if !bytes.Equal(readBuf, []byte{0xde, 0xad}) {
+		t.Fatalf("expected read buffer filled in place with {0xde, 0xad}, got %v", readBuf)
+	}
+}
+
+// Device.Transfer forwards to the same lock-free implementation, for use
+// from inside a Do callback without re-acquiring b.mu.
+func TestDeviceTransfer(t *testing.T) {
+	caller := &fakeSystemCaller{
+		funcs:        I2CFlag,
+		rdwrReadData: []byte{0x7b},
+	}
+	bus := newTestBus(t, caller)
+	readBuf := make([]byte, 1)
+	e := bus.Do(0x50, func(d *Device) error {
+		return d.Transfer([]I2CMessage{
+			{Addr: 0x50, Data: []byte{0x10}},
+			{Addr: 0x50, Flags: I2CMRD, Data: readBuf},
+		})
+	})
+	if e != nil {
+		t.Fatalf("Device.Transfer failed: %v", e)
+	}
+	if readBuf[0] != 0x7b {
+		t.Fatalf("expected read buffer filled with 0x7b, got 0x%02x", readBuf[0])
+	}
+}
+
+// Do's doc comment promises it's "the safe way to talk to a specific device
+// from multiple goroutines sharing one SMBus": address selection and the
+// following transaction happen atomically with respect to other Do callers.
+// This drives many goroutines through Do concurrently, each against its own
+// address, and checks that no I2C_SMBUS access is ever observed against the
+// wrong currently-selected address. If Do's locking were ever removed or
+// narrowed, this would both fail that check and (since currentSlaveAddr is
+// deliberately unsynchronized) trip the race detector under `go test -race`.
+func TestDoSerializesSlaveSelection(t *testing.T) {
+	const numAddrs = 8
+	const itersPerAddr = 50
+	expectedCmd := make(map[uint16]uint8, numAddrs)
+	for i := 0; i < numAddrs; i++ {
+		expectedCmd[uint16(0x10+i)] = uint8(0x80 + i)
+	}
+	var mismatch bool
+	caller := &fakeSystemCaller{
+		funcs: I2CFlag | SMBusWriteByteDataFlag,
+		onSMBusAccess: func(addr uint16, args *i2cSMBusIoctlData) {
+			if args.command != expectedCmd[addr] {
+				mismatch = true
+			}
+		},
+	}
+	bus := newTestBus(t, caller)
+	var wg sync.WaitGroup
+	for addr, cmd := range expectedCmd {
+		wg.Add(1)
+		go func(addr uint16, cmd uint8) {
+			defer wg.Done()
+			for i := 0; i < itersPerAddr; i++ {
+				if e := bus.Do(addr, func(d *Device) error {
+					return d.WriteByteData(cmd, 0)
+				}); e != nil {
+					t.Errorf("Do(0x%02x) failed: %v", addr, e)
+				}
+			}
+		}(addr, cmd)
+	}
+	wg.Wait()
+	if mismatch {
+		t.Fatalf("observed a WriteByteData command for the wrong slave address: " +
+			"Do failed to serialize address selection against the transaction")
+	}
+}
+
+// ReadBlockAt must split a read spanning more than one chunk into repeated
+// I2C block reads, advancing the register offset by the bytes actually read
+// each pass and sleeping delay between passes.
+func TestReadBlockAtChunks(t *testing.T) {
+	device := make([]byte, 10)
+	for i := range device {
+		device[i] = byte(i)
+	}
+	var commands []uint8
+	caller := &fakeSystemCaller{
+		funcs: I2CFlag | SMBusReadI2CBlockFlag,
+		smbusHandler: func(args *i2cSMBusIoctlData) {
+			commands = append(commands, args.command)
+			block := (*[I2CSMBusBlockMax + 2]byte)(args.data)
+			n := int(block[0])
+			copy(block[1:1+n], device[args.command:int(args.command)+n])
+		},
+	}
+	bus := newTestBus(t, caller)
+	const delay = 5 * time.Millisecond
+	start := time.Now()
+	result, e := bus.ReadBlockAt(0x50, 0, len(device), 4, delay)
+	elapsed := time.Since(start)
+	if e != nil {
+		t.Fatalf("ReadBlockAt failed: %v", e)
+	}
+	if !bytes.Equal(result, device) {
+		t.Fatalf("expected %v, got %v", device, result)
+	}
+	wantCommands := []uint8{0, 4, 8}
+	if !reflect.DeepEqual(commands, wantCommands) {
+		t.Fatalf("expected register offsets %v, got %v", wantCommands, commands)
+	}
+	if elapsed < 2*delay {
+		t.Fatalf("expected at least 2 inter-chunk delays of %v, took %v", delay, elapsed)
+	}
+}
+
+// WriteBlockAt is the symmetric counterpart to ReadBlockAt: it must chunk a
+// write the same way, in register-offset order. Runs with a zero delay; the
+// timing is not checked.
+func TestWriteBlockAtChunks(t *testing.T) {
+	device := make([]byte, 10)
+	var commands []uint8
+	caller := &fakeSystemCaller{
+		funcs: I2CFlag | SMBusWriteI2CBlockFlag,
+		smbusHandler: func(args *i2cSMBusIoctlData) {
+			commands = append(commands, args.command)
+			block := (*[I2CSMBusBlockMax + 2]byte)(args.data)
+			n := int(block[0])
+			copy(device[args.command:int(args.command)+n], block[1:1+n])
+		},
+	}
+	bus := newTestBus(t, caller)
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	if e := bus.WriteBlockAt(0x50, 0, data, 4, 0); e != nil {
+		t.Fatalf("WriteBlockAt failed: %v", e)
+	}
+	if !bytes.Equal(device, data) {
+		t.Fatalf("expected device memory %v, got %v", data, device)
+	}
+	wantCommands := []uint8{0, 4, 8}
+	if !reflect.DeepEqual(commands, wantCommands) {
+		t.Fatalf("expected register offsets %v, got %v", wantCommands, commands)
+	}
+}